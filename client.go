@@ -9,19 +9,30 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"rtsp-server/externalcmd"
 	"rtsp-server/rtsp"
 
 	"gortc.io/sdp"
 )
 
 var (
-	errTeardown = errors.New("teardown")
-	errPlay     = errors.New("play")
-	errRecord   = errors.New("record")
-	errWrongKey = errors.New("wrong key")
+	errTeardown            = errors.New("teardown")
+	errPlay                = errors.New("play")
+	errRecord              = errors.New("record")
+	errUnauthorized        = errors.New("unauthorized")
+	errTooManyAuthFailures = errors.New("too many authentication failures")
 )
 
+// maxAuthFailures is the number of consecutive failed authentication
+// attempts after which a client is disconnected, to make brute-forcing
+// credentials impractical.
+const maxAuthFailures = 3
+
+// authFailureDelay is slept after each failed authentication attempt.
+const authFailureDelay = 2 * time.Second
+
 func interleavedChannelToTrack(channel int) (int, trackFlow) {
 	if (channel % 2) == 0 {
 		return (channel / 2), _TRACK_FLOW_RTP
@@ -81,28 +92,39 @@ func (th transportHeader) getClientPorts() (int, int) {
 }
 
 type client struct {
-	p               *program
-	rconn           *rtsp.Conn
-	state           string
-	ip              net.IP
-	path            string
-	streamSdpText   []byte       // filled only if publisher
-	streamSdpParsed *sdp.Message // filled only if publisher
-	streamProtocol  streamProtocol
-	streamTracks    []*track
+	p                *program
+	rconn            *rtsp.Conn
+	state            string
+	ip               net.IP
+	path             string
+	streamSdpText    []byte       // filled only if publisher
+	streamSdpParsed  *sdp.Message // filled only if publisher
+	streamProtocol   streamProtocol
+	streamTracks     []*track
+	authNonce        string
+	authFailures     int
+	rtcpReceiverDone chan struct{}
+	onConnectCmd     *externalcmd.Cmd
+	onPublishCmd     *externalcmd.Cmd
+	onReadCmd        *externalcmd.Cmd
+	statsPublisher   bool
+	statsReader      bool
 }
 
 func newClient(p *program, nconn net.Conn) *client {
 	c := &client{
-		p:     p,
-		rconn: rtsp.NewConn(nconn),
-		state: "STARTING",
+		p:                p,
+		rconn:            rtsp.NewConn(nconn, time.Duration(p.conf.ReadTimeout), time.Duration(p.conf.WriteTimeout)),
+		state:            "STARTING",
+		rtcpReceiverDone: make(chan struct{}),
 	}
 
 	c.p.mutex.Lock()
 	c.p.clients[c] = struct{}{}
 	c.p.mutex.Unlock()
 
+	c.p.stats.ClientAdd(1)
+
 	return c
 }
 
@@ -114,6 +136,31 @@ func (c *client) close() error {
 
 	delete(c.p.clients, c)
 	c.rconn.Close()
+	close(c.rtcpReceiverDone)
+	c.p.stats.ClientAdd(-1)
+
+	if c.statsPublisher {
+		c.p.stats.PublisherAdd(-1)
+	}
+	if c.statsReader {
+		c.p.stats.ReaderAdd(-1)
+	}
+
+	if c.onPublishCmd != nil {
+		c.onPublishCmd.Close()
+	}
+	if c.onReadCmd != nil {
+		c.onReadCmd.Close()
+	}
+	if c.onConnectCmd != nil {
+		c.onConnectCmd.Close()
+	}
+
+	if c.streamProtocol == _STREAM_PROTOCOL_UDP {
+		for _, t := range c.streamTracks {
+			c.p.unregisterUdpPublisher(c.ip, t.rtpPort, t.rtcpPort)
+		}
+	}
 
 	if c.path != "" {
 		if pub, ok := c.p.publishers[c.path]; ok && pub == c {
@@ -149,6 +196,13 @@ func (c *client) run() {
 
 	c.log("connected")
 
+	if c.p.conf.RunOnConnect != "" {
+		c.onConnectCmd = externalcmd.New(c.p.conf.RunOnConnect, map[string]string{
+			"RTSP_PORT": strconv.Itoa(c.p.conf.RtspPort),
+			"RTSP_IP":   c.ip.String(),
+		})
+	}
+
 	for {
 		req, err := c.rconn.ReadRequest()
 		if err != nil {
@@ -197,6 +251,23 @@ func (c *client) run() {
 			c.state = "PLAY"
 			c.p.mutex.Unlock()
 
+			c.statsReader = true
+			c.p.stats.ReaderAdd(1)
+
+			// the control connection goes silent once UDP media starts
+			// flowing; don't let the read deadline drop an idle session
+			if c.streamProtocol == _STREAM_PROTOCOL_UDP {
+				c.rconn.SetReadTimeout(0)
+			}
+
+			if pconf, err := c.p.conf.PathConf(c.path); err == nil && pconf.RunOnRead != "" {
+				c.onReadCmd = externalcmd.New(pconf.RunOnRead, map[string]string{
+					"RTSP_PATH": c.path,
+					"RTSP_PORT": strconv.Itoa(c.p.conf.RtspPort),
+					"RTSP_IP":   c.ip.String(),
+				})
+			}
+
 			// when protocol is TCP, the RTSP connection becomes a RTP connection
 			// receive RTP feedback, do not parse it, wait until connection closes
 			if c.streamProtocol == _STREAM_PROTOCOL_TCP {
@@ -222,8 +293,30 @@ func (c *client) run() {
 
 			c.p.mutex.Lock()
 			c.state = "RECORD"
+			if c.streamProtocol == _STREAM_PROTOCOL_UDP {
+				for trackId, t := range c.streamTracks {
+					c.p.registerUdpPublisher(c.path, trackId, c.ip, t.rtpPort, t.rtcpPort)
+				}
+			}
 			c.p.mutex.Unlock()
 
+			c.statsPublisher = true
+			c.p.stats.PublisherAdd(1)
+
+			// the control connection goes silent once UDP media starts
+			// flowing; don't let the read deadline drop an idle session
+			if c.streamProtocol == _STREAM_PROTOCOL_UDP {
+				c.rconn.SetReadTimeout(0)
+			}
+
+			if pconf, err := c.p.conf.PathConf(c.path); err == nil && pconf.RunOnPublish != "" {
+				c.onPublishCmd = externalcmd.New(pconf.RunOnPublish, map[string]string{
+					"RTSP_PATH": c.path,
+					"RTSP_PORT": strconv.Itoa(c.p.conf.RtspPort),
+					"RTSP_IP":   c.ip.String(),
+				})
+			}
+
 			c.log("is publishing on path %s, %d %s via %s", c.path, len(c.streamTracks), func() string {
 				if len(c.streamTracks) == 1 {
 					return "track"
@@ -231,6 +324,8 @@ func (c *client) run() {
 				return "tracks"
 			}(), c.streamProtocol)
 
+			go c.runRtcpReceiverChecks()
+
 			// when protocol is TCP, the RTSP connection becomes a RTP connection
 			// receive RTP data and parse it
 			if c.streamProtocol == _STREAM_PROTOCOL_TCP {
@@ -253,23 +348,34 @@ func (c *client) run() {
 						return
 					}
 
+					if trackFlow == _TRACK_FLOW_RTP {
+						c.streamTracks[trackId].rtcpReceiver.ProcessPacket(buf[:n])
+					}
+
+					c.p.stats.AddBytesReceived(c.path, uint64(n))
+
 					c.p.mutex.RLock()
 					c.p.forwardTrack(c.path, trackId, trackFlow, buf[:n])
 					c.p.mutex.RUnlock()
 				}
 			}
 
-		// wrong key: reply with 401 and exit
-		case errWrongKey:
+		// unauthorized: challenge with digest auth and keep the connection open
+		case errUnauthorized:
 			c.log("ERR: %s", err)
 
 			c.rconn.WriteResponse(&rtsp.Response{
 				StatusCode: 401,
 				Status:     "Unauthorized",
 				Headers: map[string]string{
-					"CSeq": req.Headers["CSeq"],
+					"CSeq":             req.Headers["CSeq"],
+					"WWW-Authenticate": fmt.Sprintf(`Digest realm="%s", nonce="%s"`, authRealm, c.authNonce),
 				},
 			})
+
+		// too many failed authentication attempts: drop the connection silently
+		case errTooManyAuthFailures:
+			c.log("ERR: %s", err)
 			return
 
 		// generic error: reply with code 400 and exit
@@ -295,6 +401,114 @@ func (c *client) run() {
 	}
 }
 
+// authenticate checks req against user/pass, as configured on the path's
+// PathConf, challenging with RFC 2617 Digest auth if none or wrong
+// credentials are provided. It returns errUnauthorized if the caller must
+// reply 401, or errTooManyAuthFailures if the connection must be dropped.
+func (c *client) authenticate(req *rtsp.Request, user, pass string) error {
+	if user == "" {
+		return nil
+	}
+
+	authHeader, ok := req.Headers["Authorization"]
+	if !ok {
+		// first request of the handshake: issue the challenge, no
+		// penalty since no credentials were offered yet
+		nonce, err := generateNonce()
+		if err != nil {
+			return err
+		}
+		c.authNonce = nonce
+
+		return errUnauthorized
+	}
+
+	if strings.HasPrefix(authHeader, "Digest ") {
+		if dc, err := parseDigestHeader(authHeader); err == nil &&
+			c.authNonce != "" && checkDigest(dc, req.Method, user, pass, c.authNonce) {
+			c.authFailures = 0
+			return nil
+		}
+	} else if strings.HasPrefix(authHeader, "Basic ") {
+		if checkBasic(authHeader, user, pass) {
+			c.authFailures = 0
+			return nil
+		}
+	}
+
+	c.authFailures++
+	time.Sleep(authFailureDelay)
+
+	if c.authFailures >= maxAuthFailures {
+		return errTooManyAuthFailures
+	}
+
+	nonce, err := generateNonce()
+	if err != nil {
+		return err
+	}
+	c.authNonce = nonce
+
+	return errUnauthorized
+}
+
+// rtcpReportInterval is how often a compound RTCP receiver report is sent
+// back to a publisher.
+const rtcpReportInterval = 10 * time.Second
+
+// rtcpSilenceTimeout is how long a publishing track can go without
+// receiving a RTP packet before the client is considered dead.
+const rtcpSilenceTimeout = 5 * time.Second
+
+// runRtcpReceiverChecks periodically reports receiver statistics back to
+// a publisher and closes the client if one of its tracks has gone silent.
+// It runs for the lifetime of a RECORD session.
+func (c *client) runRtcpReceiverChecks() {
+	checkTicker := time.NewTicker(rtcpSilenceTimeout)
+	defer checkTicker.Stop()
+
+	reportTicker := time.NewTicker(rtcpReportInterval)
+	defer reportTicker.Stop()
+
+	for {
+		select {
+		case <-c.rtcpReceiverDone:
+			return
+
+		case <-checkTicker.C:
+			for _, t := range c.streamTracks {
+				if t.rtcpReceiver.Silent(rtcpSilenceTimeout) {
+					c.log("ERR: no RTP packets received in the last %s, closing", rtcpSilenceTimeout)
+					c.p.mutex.Lock()
+					c.close()
+					c.p.mutex.Unlock()
+					return
+				}
+			}
+
+		case <-reportTicker.C:
+			for trackId, t := range c.streamTracks {
+				c.sendRtcpReport(trackId, t.rtcpReceiver.Report())
+
+				lost, jitter := t.rtcpReceiver.Stats()
+				c.p.stats.SetRtpStats(c.path, lost, jitter)
+			}
+		}
+	}
+}
+
+// sendRtcpReport delivers a RTCP packet to the publisher that set up
+// trackId, over whichever transport it is using.
+func (c *client) sendRtcpReport(trackId int, report []byte) {
+	if c.streamProtocol == _STREAM_PROTOCOL_UDP {
+		t := c.streamTracks[trackId]
+		c.p.rtcpListener.WriteTo(report, &net.UDPAddr{IP: c.ip, Port: t.rtcpPort})
+		return
+	}
+
+	c.rconn.WriteInterleavedFrame(trackToInterleavedChannel(trackId, _TRACK_FLOW_RTCP), report)
+}
+
 func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 	cseq, ok := req.Headers["CSeq"]
 	if !ok {
@@ -349,6 +563,15 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 			return nil, fmt.Errorf("client is in state '%s'", c.state)
 		}
 
+		pconf, err := c.p.conf.PathConf(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := c.authenticate(req, pconf.ReadUser, pconf.ReadPass); err != nil {
+			return nil, err
+		}
+
 		sdp, err := func() ([]byte, error) {
 			c.p.mutex.RLock()
 			defer c.p.mutex.RUnlock()
@@ -358,7 +581,7 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 				return nil, fmt.Errorf("no one is streaming on path '%s'", path)
 			}
 
-			return pub.streamSdpText, nil
+			return pub.SdpText(), nil
 		}()
 		if err != nil {
 			return nil, err
@@ -408,20 +631,17 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 			return nil, fmt.Errorf("invalid SDP: %s", err)
 		}
 
-		if c.p.publishKey != "" {
-			q, err := url.ParseQuery(ur.RawQuery)
-			if err != nil {
-				return nil, fmt.Errorf("unable to parse query")
-			}
+		pconf, err := c.p.conf.PathConf(path)
+		if err != nil {
+			return nil, err
+		}
 
-			key, ok := q["key"]
-			if !ok || len(key) == 0 {
-				return nil, fmt.Errorf("key missing")
-			}
+		if pconf.Source != "" && pconf.Source != "record" {
+			return nil, fmt.Errorf("path '%s' is configured to pull from a remote source, and does not accept ANNOUNCE", path)
+		}
 
-			if key[0] != c.p.publishKey {
-				return nil, errWrongKey
-			}
+		if err := c.authenticate(req, pconf.PublishUser, pconf.PublishPass); err != nil {
+			return nil, err
 		}
 
 		err = func() error {
@@ -464,11 +684,24 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 			return nil, fmt.Errorf("transport header does not contain unicast")
 		}
 
+		pconf, err := c.p.conf.PathConf(path)
+		if err != nil {
+			return nil, err
+		}
+
 		switch c.state {
 		// play
 		case "STARTING", "PRE_PLAY":
+			if err := c.authenticate(req, pconf.ReadUser, pconf.ReadPass); err != nil {
+				return nil, err
+			}
+
 			// play via UDP
 			if _, ok := th["RTP/AVP"]; ok {
+				if !c.p.conf.HasProtocol("udp") {
+					return nil, fmt.Errorf("udp is disabled")
+				}
+
 				rtpPort, rtcpPort := th.getClientPorts()
 				if rtpPort == 0 || rtcpPort == 0 {
 					return nil, fmt.Errorf("transport header does not have valid client ports (%s)", transportstr)
@@ -491,16 +724,13 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 						return fmt.Errorf("client want to send tracks with different protocols")
 					}
 
-					if len(c.streamTracks) >= len(pub.streamSdpParsed.Medias) {
+					if len(c.streamTracks) >= len(pub.SdpParsed().Medias) {
 						return fmt.Errorf("all the tracks have already been setup")
 					}
 
 					c.path = path
 					c.streamProtocol = _STREAM_PROTOCOL_UDP
-					c.streamTracks = append(c.streamTracks, &track{
-						rtpPort:  rtpPort,
-						rtcpPort: rtcpPort,
-					})
+					c.streamTracks = append(c.streamTracks, newTrack(rtpPort, rtcpPort))
 
 					c.state = "PRE_PLAY"
 					return nil
@@ -518,7 +748,7 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 							"RTP/AVP",
 							"unicast",
 							fmt.Sprintf("client_port=%d-%d", rtpPort, rtcpPort),
-							fmt.Sprintf("server_port=%d-%d", c.p.rtpPort, c.p.rtcpPort),
+							fmt.Sprintf("server_port=%d-%d", c.p.conf.RtpPort, c.p.conf.RtcpPort),
 							"ssrc=1234ABCD",
 						}, ";"),
 						"Session": "12345678",
@@ -527,6 +757,10 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 
 				// play via TCP
 			} else if _, ok := th["RTP/AVP/TCP"]; ok {
+				if !c.p.conf.HasProtocol("tcp") {
+					return nil, fmt.Errorf("tcp is disabled")
+				}
+
 				if c.path != "" && path != c.path {
 					return nil, fmt.Errorf("path has changed")
 				}
@@ -544,16 +778,13 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 						return fmt.Errorf("client want to send tracks with different protocols")
 					}
 
-					if len(c.streamTracks) >= len(pub.streamSdpParsed.Medias) {
+					if len(c.streamTracks) >= len(pub.SdpParsed().Medias) {
 						return fmt.Errorf("all the tracks have already been setup")
 					}
 
 					c.path = path
 					c.streamProtocol = _STREAM_PROTOCOL_TCP
-					c.streamTracks = append(c.streamTracks, &track{
-						rtpPort:  0,
-						rtcpPort: 0,
-					})
+					c.streamTracks = append(c.streamTracks, newTrack(0, 0))
 
 					c.state = "PRE_PLAY"
 					return nil
@@ -584,6 +815,10 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 
 		// record
 		case "ANNOUNCE", "PRE_RECORD":
+			if err := c.authenticate(req, pconf.PublishUser, pconf.PublishPass); err != nil {
+				return nil, err
+			}
+
 			if _, ok := th["mode=record"]; !ok {
 				return nil, fmt.Errorf("transport header does not contain mode=record")
 			}
@@ -594,6 +829,10 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 
 			// record via UDP
 			if _, ok := th["RTP/AVP/UDP"]; ok {
+				if !c.p.conf.HasProtocol("udp") {
+					return nil, fmt.Errorf("udp is disabled")
+				}
+
 				rtpPort, rtcpPort := th.getClientPorts()
 				if rtpPort == 0 || rtcpPort == 0 {
 					return nil, fmt.Errorf("transport header does not have valid client ports (%s)", transportstr)
@@ -612,10 +851,7 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 					}
 
 					c.streamProtocol = _STREAM_PROTOCOL_UDP
-					c.streamTracks = append(c.streamTracks, &track{
-						rtpPort:  rtpPort,
-						rtcpPort: rtcpPort,
-					})
+					c.streamTracks = append(c.streamTracks, newTrack(rtpPort, rtcpPort))
 
 					c.state = "PRE_RECORD"
 					return nil
@@ -633,7 +869,7 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 							"RTP/AVP",
 							"unicast",
 							fmt.Sprintf("client_port=%d-%d", rtpPort, rtcpPort),
-							fmt.Sprintf("server_port=%d-%d", c.p.rtpPort, c.p.rtcpPort),
+							fmt.Sprintf("server_port=%d-%d", c.p.conf.RtpPort, c.p.conf.RtcpPort),
 							"ssrc=1234ABCD",
 						}, ";"),
 						"Session": "12345678",
@@ -642,6 +878,10 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 
 				// record via TCP
 			} else if _, ok := th["RTP/AVP/TCP"]; ok {
+				if !c.p.conf.HasProtocol("tcp") {
+					return nil, fmt.Errorf("tcp is disabled")
+				}
+
 				var interleaved string
 				err = func() error {
 					c.p.mutex.Lock()
@@ -666,10 +906,7 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 					}
 
 					c.streamProtocol = _STREAM_PROTOCOL_TCP
-					c.streamTracks = append(c.streamTracks, &track{
-						rtpPort:  0,
-						rtcpPort: 0,
-					})
+					c.streamTracks = append(c.streamTracks, newTrack(0, 0))
 
 					c.state = "PRE_RECORD"
 					return nil
@@ -718,7 +955,7 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 				return fmt.Errorf("no one is streaming on path '%s'", c.path)
 			}
 
-			if len(c.streamTracks) != len(pub.streamSdpParsed.Medias) {
+			if len(c.streamTracks) != len(pub.SdpParsed().Medias) {
 				return fmt.Errorf("not all tracks have been setup")
 			}
 
@@ -799,4 +1036,4 @@ func (c *client) handleRequest(req *rtsp.Request) (*rtsp.Response, error) {
 	default:
 		return nil, fmt.Errorf("unhandled method '%s'", req.Method)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,139 @@
+// Package conf loads the server's YAML configuration file: global
+// settings plus a set of per-path definitions.
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Duration is a time.Duration that unmarshals from a YAML string such as
+// "5s" or "500ms", rather than from a raw integer nanosecond count.
+type Duration time.Duration
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration '%s': %s", s, err)
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// PathConf is the configuration of a single path.
+type PathConf struct {
+	Source         string `yaml:"source"`
+	SourceProtocol string `yaml:"sourceProtocol"`
+	ReadUser       string `yaml:"readUser"`
+	ReadPass       string `yaml:"readPass"`
+	PublishUser    string `yaml:"publishUser"`
+	PublishPass    string `yaml:"publishPass"`
+	RunOnPublish   string `yaml:"runOnPublish"`
+	RunOnRead      string `yaml:"runOnRead"`
+
+	// regexp is set when the path name starts with "~", turning it into a
+	// pattern that matches any path rather than a single one.
+	regexp *regexp.Regexp
+}
+
+// Conf is the whole server configuration.
+type Conf struct {
+	RtspPort     int                  `yaml:"rtspPort"`
+	RtpPort      int                  `yaml:"rtpPort"`
+	RtcpPort     int                  `yaml:"rtcpPort"`
+	MetricsPort  int                  `yaml:"metricsPort"`
+	PprofPort    int                  `yaml:"pprofPort"`
+	Protocols    []string             `yaml:"protocols"`
+	ReadTimeout  Duration             `yaml:"readTimeout"`
+	WriteTimeout Duration             `yaml:"writeTimeout"`
+	RunOnConnect string               `yaml:"runOnConnect"`
+	Paths        map[string]*PathConf `yaml:"paths"`
+}
+
+// Load reads, validates and applies defaults to the configuration file at
+// fpath.
+func Load(fpath string) (*Conf, error) {
+	content, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &Conf{}
+	err = yaml.Unmarshal(content, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.RtspPort == 0 {
+		conf.RtspPort = 8554
+	}
+	if conf.RtpPort == 0 {
+		conf.RtpPort = 8000
+	}
+	if conf.RtcpPort == 0 {
+		conf.RtcpPort = 8001
+	}
+	if len(conf.Protocols) == 0 {
+		conf.Protocols = []string{"udp", "tcp"}
+	}
+	if conf.ReadTimeout == 0 {
+		conf.ReadTimeout = Duration(5 * time.Second)
+	}
+	if conf.WriteTimeout == 0 {
+		conf.WriteTimeout = Duration(5 * time.Second)
+	}
+	if conf.Paths == nil {
+		conf.Paths = make(map[string]*PathConf)
+	}
+
+	for name, pconf := range conf.Paths {
+		if strings.HasPrefix(name, "~") {
+			r, err := regexp.Compile(name[1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression in path name '%s': %s", name, err)
+			}
+			pconf.regexp = r
+		}
+	}
+
+	return conf, nil
+}
+
+// HasProtocol returns whether proto ("udp" or "tcp") is among the
+// protocols enabled server-wide.
+func (conf *Conf) HasProtocol(proto string) bool {
+	for _, p := range conf.Protocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// PathConf returns the configuration matching name: an exact match is
+// tried first, followed by every regular-expression path.
+func (conf *Conf) PathConf(name string) (*PathConf, error) {
+	if pconf, ok := conf.Paths[name]; ok {
+		return pconf, nil
+	}
+
+	for _, pconf := range conf.Paths {
+		if pconf.regexp != nil && pconf.regexp.MatchString(name) {
+			return pconf, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unable to find a configuration for path '%s'", name)
+}
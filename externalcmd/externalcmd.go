@@ -0,0 +1,84 @@
+// Package externalcmd runs and supervises the shell commands configured
+// as runOnConnect, runOnPublish and runOnRead hooks.
+package externalcmd
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// restartPause is how long Cmd waits before restarting a command that has
+// exited, so that a misconfigured hook does not spin.
+const restartPause = 5 * time.Second
+
+// Cmd runs a shell command in the background, restarting it if it exits,
+// until Close is called.
+type Cmd struct {
+	terminate chan struct{}
+	done      chan struct{}
+}
+
+// New starts command in the background, with env added to its
+// environment, and restarts it every time it exits. Call Close to stop
+// it.
+func New(command string, env map[string]string) *Cmd {
+	e := &Cmd{
+		terminate: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go e.run(command, env)
+
+	return e
+}
+
+// Close stops the command, killing it if it is currently running, and
+// waits for its supervising goroutine to exit.
+func (e *Cmd) Close() {
+	close(e.terminate)
+	<-e.done
+}
+
+func (e *Cmd) run(command string, env map[string]string) {
+	defer close(e.done)
+
+	for {
+		cmd := exec.Command("/bin/sh", "-c", command)
+		cmd.Env = os.Environ()
+		for k, v := range env {
+			cmd.Env = append(cmd.Env, k+"="+v)
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		err := cmd.Start()
+		if err != nil {
+			log.Printf("ERR: %s", err)
+		} else {
+			exitc := make(chan error, 1)
+			go func() {
+				exitc <- cmd.Wait()
+			}()
+
+			select {
+			case <-e.terminate:
+				cmd.Process.Kill()
+				<-exitc
+				return
+
+			case err := <-exitc:
+				if err != nil {
+					log.Printf("ERR: %s", err)
+				}
+			}
+		}
+
+		select {
+		case <-e.terminate:
+			return
+		case <-time.After(restartPause):
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"rtsp-server/conf"
+)
+
+func main() {
+	confPath := flag.String("config", "rtsp-simple-server.yml", "path to the configuration file")
+	flag.Parse()
+
+	cnf, err := conf.Load(*confPath)
+	if err != nil {
+		log.Fatal("ERR: ", err)
+	}
+
+	p, err := newProgram(cnf)
+	if err != nil {
+		log.Fatal("ERR: ", err)
+	}
+
+	log.Printf("RTSP server listening on :%d", cnf.RtspPort)
+	go p.run()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	<-sigs
+
+	p.close()
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync"
+
+	"rtsp-server/conf"
+	"rtsp-server/serverudp"
+	"rtsp-server/source"
+	"rtsp-server/stats"
+)
+
+// udpPublisherAddr identifies the track a publisher's RTP or RTCP packets
+// belong to, keyed by the source address they are sent from.
+type udpPublisherAddr struct {
+	path    string
+	trackId int
+	flow    trackFlow
+}
+
+// program holds the global, process-wide server state: the RTSP listener,
+// the set of connected clients, and the publisher registered on each path.
+type program struct {
+	mutex sync.RWMutex
+	conf  *conf.Conf
+
+	listener      *net.TCPListener
+	rtpListener   *serverudp.Server
+	rtcpListener  *serverudp.Server
+	clients       map[*client]struct{}
+	publishers    map[string]publisher
+	udpPublishers map[string]udpPublisherAddr
+	sources       map[string]*source.Source
+	stats         *stats.Stats
+	metricsServer *http.Server
+	pprofServer   *http.Server
+}
+
+func newProgram(conf *conf.Conf) (*program, error) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: conf.RtspPort})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &program{
+		conf:          conf,
+		listener:      listener,
+		clients:       make(map[*client]struct{}),
+		publishers:    make(map[string]publisher),
+		udpPublishers: make(map[string]udpPublisherAddr),
+		sources:       make(map[string]*source.Source),
+		stats:         stats.New(),
+	}
+
+	p.rtpListener, err = serverudp.New(conf.RtpPort, func(buf []byte, addr *net.UDPAddr) {
+		p.onUdpPacket(_TRACK_FLOW_RTP, buf, addr)
+	})
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	p.rtcpListener, err = serverudp.New(conf.RtcpPort, func(buf []byte, addr *net.UDPAddr) {
+		p.onUdpPacket(_TRACK_FLOW_RTCP, buf, addr)
+	})
+	if err != nil {
+		listener.Close()
+		p.rtpListener.Close()
+		return nil, err
+	}
+
+	for name, pconf := range conf.Paths {
+		if !strings.HasPrefix(name, "~") && pconf.Source != "" && pconf.Source != "record" {
+			p.startSource(name, pconf)
+		}
+	}
+
+	if conf.MetricsPort != 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", p.stats)
+
+		p.metricsServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", conf.MetricsPort),
+			Handler: mux,
+		}
+		go p.metricsServer.ListenAndServe()
+	}
+
+	if conf.PprofPort != 0 {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		p.pprofServer = &http.Server{
+			Addr:    fmt.Sprintf(":%d", conf.PprofPort),
+			Handler: mux,
+		}
+		go p.pprofServer.ListenAndServe()
+	}
+
+	return p, nil
+}
+
+// close shuts the program down: every pull-mode source is stopped and
+// deregistered, the metrics/pprof HTTP servers are closed, and the
+// TCP/UDP sockets are closed.
+func (p *program) close() {
+	p.mutex.Lock()
+	for path, src := range p.sources {
+		delete(p.publishers, path)
+		src.Close()
+	}
+	p.mutex.Unlock()
+
+	if p.metricsServer != nil {
+		p.metricsServer.Close()
+	}
+	if p.pprofServer != nil {
+		p.pprofServer.Close()
+	}
+
+	p.listener.Close()
+	p.rtpListener.Close()
+	p.rtcpListener.Close()
+}
+
+// startSource spawns a pull-mode source for a path configured with a
+// remote `source:` URL, and registers it as the path's publisher once it
+// has successfully fetched the remote SDP and started playing the stream.
+func (p *program) startSource(path string, pconf *conf.PathConf) {
+	protocol := pconf.SourceProtocol
+	if protocol == "" {
+		protocol = "udp"
+	}
+
+	src := source.New(path, pconf.Source, protocol,
+		func(src *source.Source) {
+			p.mutex.Lock()
+			p.publishers[path] = src
+			p.mutex.Unlock()
+		},
+		func(trackId int, flow source.Flow, buf []byte) {
+			p.stats.AddBytesReceived(path, uint64(len(buf)))
+
+			p.mutex.RLock()
+			p.forwardTrack(path, trackId, sourceFlowToTrackFlow(flow), buf)
+			p.mutex.RUnlock()
+		})
+
+	p.sources[path] = src
+}
+
+func sourceFlowToTrackFlow(flow source.Flow) trackFlow {
+	if flow == source.FlowRTP {
+		return _TRACK_FLOW_RTP
+	}
+	return _TRACK_FLOW_RTCP
+}
+
+func (p *program) run() {
+	for {
+		nconn, err := p.listener.Accept()
+		if err != nil {
+			log.Printf("ERR: %s", err)
+			return
+		}
+
+		c := newClient(p, nconn)
+		go c.run()
+	}
+}
+
+// onUdpPacket is called by the RTP and RTCP server sockets for every
+// packet they receive. It looks the source address up against the table
+// of registered UDP publishers and, if found, forwards the packet to
+// every subscriber of that track.
+func (p *program) onUdpPacket(flow trackFlow, buf []byte, addr *net.UDPAddr) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	pub, ok := p.udpPublishers[udpAddrKey(addr.IP, addr.Port)]
+	if !ok || pub.flow != flow {
+		return
+	}
+
+	if flow == _TRACK_FLOW_RTP {
+		if rawPub, ok := p.publishers[pub.path]; ok {
+			if pubClient, ok := rawPub.(*client); ok && pub.trackId < len(pubClient.streamTracks) {
+				pubClient.streamTracks[pub.trackId].rtcpReceiver.ProcessPacket(buf)
+			}
+		}
+	}
+
+	p.stats.AddBytesReceived(pub.path, uint64(len(buf)))
+
+	p.forwardTrack(pub.path, pub.trackId, flow, buf)
+}
+
+// registerUdpPublisher records that packets coming from ip:port belong to
+// the given track of path, so that onUdpPacket can route them. The caller
+// must hold p.mutex for writing.
+func (p *program) registerUdpPublisher(path string, trackId int, ip net.IP, rtpPort, rtcpPort int) {
+	p.udpPublishers[udpAddrKey(ip, rtpPort)] = udpPublisherAddr{path: path, trackId: trackId, flow: _TRACK_FLOW_RTP}
+	p.udpPublishers[udpAddrKey(ip, rtcpPort)] = udpPublisherAddr{path: path, trackId: trackId, flow: _TRACK_FLOW_RTCP}
+}
+
+// unregisterUdpPublisher reverses registerUdpPublisher. The caller must
+// hold p.mutex for writing.
+func (p *program) unregisterUdpPublisher(ip net.IP, rtpPort, rtcpPort int) {
+	delete(p.udpPublishers, udpAddrKey(ip, rtpPort))
+	delete(p.udpPublishers, udpAddrKey(ip, rtcpPort))
+}
+
+func udpAddrKey(ip net.IP, port int) string {
+	return fmt.Sprintf("%s:%d", ip.String(), port)
+}
+
+// forwardTrack sends a RTP or RTCP packet, received from the publisher of
+// path, to every client that is playing that path and has set up the
+// corresponding track. The caller must hold at least a read lock on
+// p.mutex.
+func (p *program) forwardTrack(path string, id int, flow trackFlow, buf []byte) {
+	for c := range p.clients {
+		if c.path == path && c.state == "PLAY" && id < len(c.streamTracks) {
+			switch c.streamProtocol {
+			case _STREAM_PROTOCOL_TCP:
+				channel := trackToInterleavedChannel(id, flow)
+				c.rconn.WriteInterleavedFrame(channel, buf)
+
+			case _STREAM_PROTOCOL_UDP:
+				t := c.streamTracks[id]
+				port := t.rtpPort
+				listener := p.rtpListener
+				if flow == _TRACK_FLOW_RTCP {
+					port = t.rtcpPort
+					listener = p.rtcpListener
+				}
+
+				listener.WriteTo(buf, &net.UDPAddr{IP: c.ip, Port: port})
+			}
+
+			p.stats.AddBytesSent(path, uint64(len(buf)))
+		}
+	}
+}
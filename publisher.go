@@ -0,0 +1,20 @@
+package main
+
+import "gortc.io/sdp"
+
+// publisher is the source of a path's stream: either a RTSP client that
+// ANNOUNCEd it, or a pull-mode source connected to a remote RTSP server.
+type publisher interface {
+	SdpText() []byte
+	SdpParsed() *sdp.Message
+}
+
+// SdpText returns the raw SDP announced by the client.
+func (c *client) SdpText() []byte {
+	return c.streamSdpText
+}
+
+// SdpParsed returns the parsed SDP announced by the client.
+func (c *client) SdpParsed() *sdp.Message {
+	return c.streamSdpParsed
+}
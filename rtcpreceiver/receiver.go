@@ -0,0 +1,188 @@
+// Package rtcpreceiver turns a stream of incoming RTP packets into
+// periodic RTCP receiver reports, as described in RFC 3550, and tracks
+// whether a track has gone silent.
+package rtcpreceiver
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// reportSSRC is the SSRC the server reports itself as, matching the
+// "ssrc=1234ABCD" advertised in SETUP responses.
+const reportSSRC = 0x1234abcd
+
+// DefaultClockRate is the RTP clock rate assumed for a track when the
+// server has no way to learn the real one from the SDP. It matches the
+// dynamic payload types (e.g. H264) this server is built around.
+const DefaultClockRate = 90000
+
+// Receiver accumulates sequence number, jitter and timing statistics for
+// a single RTP track.
+type Receiver struct {
+	mutex sync.Mutex
+
+	clockRate      uint32
+	started        bool
+	ssrc           uint32
+	baseSeq        uint32
+	maxSeq         uint16
+	cycles         uint32
+	received       uint64
+	expectedPrior  uint64
+	receivedPrior  uint64
+	jitter         float64
+	lastTransit    int64
+	lastPacketTime time.Time
+}
+
+// New allocates a Receiver. clockRate is the track's RTP clock rate, in
+// Hz, used to convert wall-clock arrival times into RTP timestamp units
+// when computing interarrival jitter.
+func New(clockRate uint32) *Receiver {
+	return &Receiver{clockRate: clockRate}
+}
+
+// ProcessPacket parses the header of a RTP packet and updates the
+// receiver's statistics. It must be called for every RTP packet received
+// on the track.
+func (r *Receiver) ProcessPacket(buf []byte) {
+	if len(buf) < 12 {
+		return
+	}
+
+	seq := binary.BigEndian.Uint16(buf[2:4])
+	timestamp := binary.BigEndian.Uint32(buf[4:8])
+	ssrc := binary.BigEndian.Uint32(buf[8:12])
+
+	now := time.Now()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.started {
+		r.started = true
+		r.ssrc = ssrc
+		r.baseSeq = uint32(seq)
+		r.maxSeq = seq
+	} else if int16(seq-r.maxSeq) > 0 {
+		if seq < r.maxSeq {
+			r.cycles += 0x10000
+		}
+		r.maxSeq = seq
+	}
+
+	// convert the arrival wall-clock time into the track's RTP timestamp
+	// units, as required by the jitter formula in RFC 3550 section 6.4.1
+	arrival := now.Unix()*int64(r.clockRate) +
+		int64(now.Nanosecond())*int64(r.clockRate)/int64(time.Second)
+	transit := arrival - int64(timestamp)
+	if r.received > 0 {
+		d := transit - r.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		r.jitter += (float64(d) - r.jitter) / 16
+	}
+	r.lastTransit = transit
+
+	r.received++
+	r.lastPacketTime = now
+}
+
+// Silent returns true if at least one packet has been received on the
+// track but none has arrived in the last timeout, meaning the publisher
+// has likely stopped streaming.
+func (r *Receiver) Silent(timeout time.Duration) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.started && time.Since(r.lastPacketTime) > timeout
+}
+
+// Stats returns the cumulative packet loss and the current jitter, in
+// seconds, for display on the server's stats surface. Unlike Report, it
+// does not advance the RR-interval priors, so it can be called
+// independently of the reporting schedule.
+func (r *Receiver) Stats() (lost uint32, jitter float64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	expected := uint64(r.cycles) + uint64(r.maxSeq) - uint64(r.baseSeq) + 1
+	lost64 := int64(expected) - int64(r.received)
+	if lost64 < 0 {
+		lost64 = 0
+	}
+
+	return uint32(lost64), r.jitter / float64(r.clockRate)
+}
+
+// Report builds a compound RTCP packet (a Receiver Report followed by a
+// SDES CNAME chunk) describing the track as currently known. It must be
+// called roughly every 10 seconds so that the publisher gets periodic
+// feedback and its NAT binding is kept alive.
+func (r *Receiver) Report() []byte {
+	r.mutex.Lock()
+	extMaxSeq := r.cycles + uint32(r.maxSeq)
+	cumulativeExpected := uint64(extMaxSeq) - uint64(r.baseSeq) + 1
+	expected := cumulativeExpected - r.expectedPrior
+	received := r.received - r.receivedPrior
+	r.expectedPrior = cumulativeExpected
+	r.receivedPrior = r.received
+
+	intervalLost64 := int64(expected) - int64(received)
+	if intervalLost64 < 0 {
+		intervalLost64 = 0
+	}
+
+	var fractionLost byte
+	if expected > 0 && intervalLost64 > 0 {
+		fractionLost = byte((intervalLost64 * 256) / int64(expected))
+	}
+
+	// the RR's "cumulative number of packets lost" field (RFC 3550 section
+	// 6.4.1) is the total loss since the start of reception, not the
+	// interval loss used for fractionLost above
+	cumulativeLost64 := int64(cumulativeExpected) - int64(r.received)
+	if cumulativeLost64 < 0 {
+		cumulativeLost64 = 0
+	}
+	if cumulativeLost64 > 0xffffff {
+		cumulativeLost64 = 0xffffff
+	}
+
+	ssrc := r.ssrc
+	jitter := uint32(r.jitter)
+	r.mutex.Unlock()
+
+	rr := make([]byte, 32)
+	rr[0] = 0x81 // V=2, P=0, RC=1
+	rr[1] = 201  // PT=RR
+	binary.BigEndian.PutUint16(rr[2:4], 7)
+	binary.BigEndian.PutUint32(rr[4:8], reportSSRC)
+
+	binary.BigEndian.PutUint32(rr[8:12], ssrc)
+	rr[12] = fractionLost
+	rr[13] = byte(cumulativeLost64 >> 16)
+	rr[14] = byte(cumulativeLost64 >> 8)
+	rr[15] = byte(cumulativeLost64)
+	binary.BigEndian.PutUint32(rr[16:20], extMaxSeq)
+	binary.BigEndian.PutUint32(rr[20:24], jitter)
+	// LSR and DLSR are left at zero: the server does not track when it
+	// last received a sender report from the publisher.
+
+	const cname = "rtsp-server"
+	sdesLen := 4 + 2 + len(cname) // ssrc + item header + text
+	pad := (4 - (sdesLen % 4)) % 4
+	sdes := make([]byte, 4+sdesLen+pad)
+	sdes[0] = 0x81 // V=2, P=0, SC=1
+	sdes[1] = 202  // PT=SDES
+	binary.BigEndian.PutUint16(sdes[2:4], uint16((len(sdes)/4)-1))
+	binary.BigEndian.PutUint32(sdes[4:8], reportSSRC)
+	sdes[8] = 1 // CNAME
+	sdes[9] = byte(len(cname))
+	copy(sdes[10:], cname)
+
+	return append(rr, sdes...)
+}
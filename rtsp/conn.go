@@ -0,0 +1,341 @@
+package rtsp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxRequestLine avoids reading forever on a malformed client.
+	maxRequestLine = 4096
+)
+
+// Conn is a RTSP connection, wrapping a net.Conn with request/response
+// framing and interleaved-frame support.
+type Conn struct {
+	nconn        net.Conn
+	br           *bufio.Reader
+	bw           *bufio.Writer
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// NewConn allocates a Conn. readTimeout and writeTimeout bound how long
+// reading a request/response and writing a response/request may take;
+// zero disables the corresponding deadline. They are not applied to raw
+// reads/writes of already-established RTP/RTCP streams.
+func NewConn(nconn net.Conn, readTimeout, writeTimeout time.Duration) *Conn {
+	return &Conn{
+		nconn:        nconn,
+		br:           bufio.NewReader(nconn),
+		bw:           bufio.NewWriter(nconn),
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+	}
+}
+
+// Close closes the underlying connection.
+func (c *Conn) Close() error {
+	return c.nconn.Close()
+}
+
+// SetReadTimeout replaces the read deadline applied to ReadRequest and
+// ReadResponse. Passing 0 disables it, which callers must do once a
+// session has switched to UDP-based streaming: the control connection
+// then goes silent until the next PAUSE/TEARDOWN, which can arrive
+// arbitrarily late.
+func (c *Conn) SetReadTimeout(d time.Duration) {
+	c.readTimeout = d
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.nconn.RemoteAddr()
+}
+
+// Read reads raw bytes from the connection, used once a session has
+// switched to TCP-interleaved RTP.
+func (c *Conn) Read(buf []byte) (int, error) {
+	return c.br.Read(buf)
+}
+
+func (c *Conn) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := c.br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == '\n' {
+			break
+		}
+		if len(line) >= maxRequestLine {
+			return "", fmt.Errorf("line too long")
+		}
+		line = append(line, b)
+	}
+	return strings.TrimRight(string(line), "\r"), nil
+}
+
+func (c *Conn) readHeaders() (map[string]string, []byte, error) {
+	headers := make(map[string]string)
+
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if line == "" {
+			break
+		}
+
+		n := strings.Index(line, ":")
+		if n < 0 {
+			return nil, nil, fmt.Errorf("invalid header '%s'", line)
+		}
+
+		key := strings.TrimSpace(line[:n])
+		val := strings.TrimSpace(line[n+1:])
+		headers[key] = val
+	}
+
+	var content []byte
+	if cl, ok := headers["Content-Length"]; ok {
+		n, err := strconv.Atoi(cl)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid Content-Length '%s'", cl)
+		}
+
+		if n > 0 {
+			content = make([]byte, n)
+			_, err := readFull(c.br, content)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return headers, content, nil
+}
+
+func (c *Conn) applyReadTimeout() func() {
+	if c.readTimeout == 0 {
+		return func() {}
+	}
+
+	c.nconn.SetReadDeadline(time.Now().Add(c.readTimeout))
+	return func() { c.nconn.SetReadDeadline(time.Time{}) }
+}
+
+func (c *Conn) applyWriteTimeout() func() {
+	if c.writeTimeout == 0 {
+		return func() {}
+	}
+
+	c.nconn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	return func() { c.nconn.SetWriteDeadline(time.Time{}) }
+}
+
+// WriteRequest writes a RTSP request to the connection, used when acting
+// as a RTSP client against a remote server.
+func (c *Conn) WriteRequest(req *Request) error {
+	defer c.applyWriteTimeout()()
+
+	_, err := fmt.Fprintf(c.bw, "%s %s RTSP/1.0\r\n", req.Method, req.Url)
+	if err != nil {
+		return err
+	}
+
+	if req.Content != nil {
+		if req.Headers == nil {
+			req.Headers = make(map[string]string)
+		}
+		req.Headers["Content-Length"] = strconv.Itoa(len(req.Content))
+	}
+
+	for key, val := range req.Headers {
+		_, err := fmt.Fprintf(c.bw, "%s: %s\r\n", key, val)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprint(c.bw, "\r\n")
+	if err != nil {
+		return err
+	}
+
+	if req.Content != nil {
+		_, err = c.bw.Write(req.Content)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.bw.Flush()
+}
+
+// ReadResponse reads a RTSP response from the connection, used when
+// acting as a RTSP client against a remote server.
+func (c *Conn) ReadResponse() (*Response, error) {
+	defer c.applyReadTimeout()()
+
+	statusLine, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(statusLine, " ", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid status line '%s'", statusLine)
+	}
+
+	statusCode, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid status code '%s'", parts[1])
+	}
+
+	headers, content, err := c.readHeaders()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Response{
+		StatusCode: statusCode,
+		Status:     parts[2],
+		Headers:    headers,
+		Content:    content,
+	}, nil
+}
+
+// ReadRequest reads a RTSP request from the connection.
+func (c *Conn) ReadRequest() (*Request, error) {
+	defer c.applyReadTimeout()()
+
+	reqLine, err := c.readLine()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(reqLine, " ", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid request line '%s'", reqLine)
+	}
+
+	headers, content, err := c.readHeaders()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Request{
+		Method:  parts[0],
+		Url:     parts[1],
+		Headers: headers,
+		Content: content,
+	}, nil
+}
+
+func readFull(br *bufio.Reader, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := br.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// WriteResponse writes a RTSP response to the connection.
+func (c *Conn) WriteResponse(res *Response) error {
+	defer c.applyWriteTimeout()()
+
+	status := res.Status
+	if status == "" {
+		status = "OK"
+	}
+
+	_, err := fmt.Fprintf(c.bw, "RTSP/1.0 %d %s\r\n", res.StatusCode, status)
+	if err != nil {
+		return err
+	}
+
+	if res.Content != nil {
+		if res.Headers == nil {
+			res.Headers = make(map[string]string)
+		}
+		res.Headers["Content-Length"] = strconv.Itoa(len(res.Content))
+	}
+
+	for key, val := range res.Headers {
+		_, err := fmt.Fprintf(c.bw, "%s: %s\r\n", key, val)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprint(c.bw, "\r\n")
+	if err != nil {
+		return err
+	}
+
+	if res.Content != nil {
+		_, err = c.bw.Write(res.Content)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.bw.Flush()
+}
+
+// ReadInterleavedFrame reads a single RTSP-interleaved ($-prefixed) frame
+// and returns its channel number and length.
+func (c *Conn) ReadInterleavedFrame(buf []byte) (int, int, error) {
+	header := make([]byte, 4)
+	_, err := readFull(c.br, header)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if header[0] != '$' {
+		return 0, 0, fmt.Errorf("invalid interleaved frame header")
+	}
+
+	channel := int(header[1])
+	size := int(header[2])<<8 | int(header[3])
+
+	if size > len(buf) {
+		return 0, 0, fmt.Errorf("frame too big (%d bytes)", size)
+	}
+
+	_, err = readFull(c.br, buf[:size])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return channel, size, nil
+}
+
+// WriteInterleavedFrame writes a single RTSP-interleaved ($-prefixed) frame.
+func (c *Conn) WriteInterleavedFrame(channel int, buf []byte) error {
+	header := []byte{'$', byte(channel), byte(len(buf) >> 8), byte(len(buf))}
+
+	_, err := c.bw.Write(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.bw.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	return c.bw.Flush()
+}
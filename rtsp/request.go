@@ -0,0 +1,9 @@
+package rtsp
+
+// Request is a RTSP request.
+type Request struct {
+	Method  string
+	Url     string
+	Headers map[string]string
+	Content []byte
+}
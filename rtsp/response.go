@@ -0,0 +1,9 @@
+package rtsp
+
+// Response is a RTSP response.
+type Response struct {
+	StatusCode int
+	Status     string
+	Headers    map[string]string
+	Content    []byte
+}
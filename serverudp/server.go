@@ -0,0 +1,57 @@
+// Package serverudp implements a UDP socket that can be shared between a
+// RTP or RTCP source (a publisher) and any number of destinations (the
+// players), so that all traffic for a given flow goes through a single,
+// symmetric NAT-friendly binding.
+package serverudp
+
+import "net"
+
+// OnPacket is called for every packet received on the socket, with its
+// payload and the address it was sent from.
+type OnPacket func(buf []byte, addr *net.UDPAddr)
+
+// Server is a UDP listener that dispatches incoming packets to a callback
+// and allows writing packets back out through the same socket.
+type Server struct {
+	conn *net.UDPConn
+}
+
+// New allocates a Server bound to port and starts reading packets into
+// onPacket in the background.
+func New(port int, onPacket OnPacket) (*Server, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		conn: conn,
+	}
+
+	go s.run(onPacket)
+
+	return s, nil
+}
+
+func (s *Server) run(onPacket OnPacket) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		onPacket(buf[:n], addr)
+	}
+}
+
+// WriteTo sends buf to addr through the server's socket.
+func (s *Server) WriteTo(buf []byte, addr *net.UDPAddr) error {
+	_, err := s.conn.WriteToUDP(buf, addr)
+	return err
+}
+
+// Close closes the underlying socket, terminating the read loop.
+func (s *Server) Close() error {
+	return s.conn.Close()
+}
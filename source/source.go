@@ -0,0 +1,384 @@
+// Package source implements a pull-mode RTSP client: it connects to a
+// remote RTSP server, plays the path it is configured with, and feeds
+// every received RTP/RTCP packet to a callback, so that the stream can be
+// re-published locally exactly as if it had arrived via ANNOUNCE.
+package source
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rtsp-server/rtsp"
+
+	"gortc.io/sdp"
+)
+
+// Flow identifies whether a packet belongs to the RTP or RTCP flow of a
+// track.
+type Flow int
+
+const (
+	FlowRTP Flow = iota
+	FlowRTCP
+)
+
+// OnPacket is called for every RTP/RTCP packet read from the remote
+// server.
+type OnPacket func(trackId int, flow Flow, buf []byte)
+
+// reconnectPause is how long Source waits before retrying a failed
+// connection.
+const reconnectPause = 5 * time.Second
+
+// dialTimeout bounds how long connecting to, and exchanging control
+// requests with, the remote server can take.
+const dialTimeout = 10 * time.Second
+
+// Source pulls a stream from a remote RTSP server and re-exposes it under
+// a local path.
+type Source struct {
+	path     string
+	url      string
+	protocol string
+	onPacket OnPacket
+
+	mutex     sync.RWMutex
+	sdpText   []byte
+	sdpParsed *sdp.Message
+
+	terminate chan struct{}
+	done      chan struct{}
+}
+
+// New starts pulling rawUrl (protocol is "udp" or "tcp") in the
+// background and calling onPacket for every packet it receives. onReady
+// is called once, the first time the remote stream has been described,
+// set up and played successfully. Call Close to stop the source.
+func New(path, rawUrl, protocol string, onReady func(*Source), onPacket OnPacket) *Source {
+	s := &Source{
+		path:      path,
+		url:       rawUrl,
+		protocol:  protocol,
+		onPacket:  onPacket,
+		terminate: make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go s.run(onReady)
+
+	return s
+}
+
+// Close stops the source and waits for its goroutine to exit.
+func (s *Source) Close() {
+	close(s.terminate)
+	<-s.done
+}
+
+// SdpText returns the SDP announced by the remote server, as received via
+// DESCRIBE.
+func (s *Source) SdpText() []byte {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.sdpText
+}
+
+// SdpParsed returns the parsed SDP announced by the remote server.
+func (s *Source) SdpParsed() *sdp.Message {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.sdpParsed
+}
+
+func (s *Source) run(onReady func(*Source)) {
+	defer close(s.done)
+
+	ready := false
+
+	for {
+		err := s.runInner(&ready, onReady)
+		if err != nil {
+			log.Printf("[source %s] ERR: %s", s.path, err)
+		}
+
+		select {
+		case <-s.terminate:
+			return
+		case <-time.After(reconnectPause):
+		}
+	}
+}
+
+// track holds the per-media state built up during SETUP.
+type track struct {
+	rtpConn  *net.UDPConn
+	rtcpConn *net.UDPConn
+}
+
+func (s *Source) runInner(ready *bool, onReady func(*Source)) error {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(host, "554")
+	}
+
+	nconn, err := net.DialTimeout("tcp", host, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer nconn.Close()
+
+	conn := rtsp.NewConn(nconn, dialTimeout, dialTimeout)
+
+	cseq := 0
+	session := ""
+	do := func(method, url string, extraHeaders map[string]string, content []byte) (*rtsp.Response, error) {
+		cseq++
+		headers := map[string]string{"CSeq": strconv.Itoa(cseq)}
+		if session != "" {
+			headers["Session"] = session
+		}
+		for k, v := range extraHeaders {
+			headers[k] = v
+		}
+
+		err := conn.WriteRequest(&rtsp.Request{
+			Method:  method,
+			Url:     url,
+			Headers: headers,
+			Content: content,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := conn.ReadResponse()
+		if err != nil {
+			return nil, err
+		}
+
+		if sh, ok := res.Headers["Session"]; ok {
+			session = parseSessionHeader(sh)
+		}
+
+		return res, nil
+	}
+
+	res, err := do("OPTIONS", s.url, nil, nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("OPTIONS returned code %d", res.StatusCode)
+	}
+
+	res, err = do("DESCRIBE", s.url, map[string]string{"Accept": "application/sdp"}, nil)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 200 {
+		return fmt.Errorf("DESCRIBE returned code %d", res.StatusCode)
+	}
+
+	sdpParsed, err := decodeSdp(res.Content)
+	if err != nil {
+		return fmt.Errorf("invalid SDP: %s", err)
+	}
+
+	s.mutex.Lock()
+	s.sdpText = res.Content
+	s.sdpParsed = sdpParsed
+	s.mutex.Unlock()
+
+	sessionControlURL, err := resolveControlURL(s.url, sdpParsed.Attribute("control"))
+	if err != nil {
+		return fmt.Errorf("invalid session control URL: %s", err)
+	}
+
+	tracks := make([]track, len(sdpParsed.Medias))
+
+	for i, media := range sdpParsed.Medias {
+		trackURL, err := resolveControlURL(sessionControlURL, media.Attribute("control"))
+		if err != nil {
+			closeTracks(tracks)
+			return fmt.Errorf("invalid track control URL: %s", err)
+		}
+
+		var transport string
+
+		if s.protocol == "tcp" {
+			transport = fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", i*2, i*2+1)
+		} else {
+			rtpConn, rtcpConn, err := listenUdpPair()
+			if err != nil {
+				closeTracks(tracks)
+				return err
+			}
+
+			tracks[i].rtpConn = rtpConn
+			tracks[i].rtcpConn = rtcpConn
+
+			transport = fmt.Sprintf("RTP/AVP;unicast;client_port=%d-%d",
+				rtpConn.LocalAddr().(*net.UDPAddr).Port, rtcpConn.LocalAddr().(*net.UDPAddr).Port)
+		}
+
+		res, err := do("SETUP", trackURL, map[string]string{"Transport": transport}, nil)
+		if err != nil {
+			closeTracks(tracks)
+			return err
+		}
+		if res.StatusCode != 200 {
+			closeTracks(tracks)
+			return fmt.Errorf("SETUP returned code %d", res.StatusCode)
+		}
+	}
+
+	res, err = do("PLAY", sessionControlURL, nil, nil)
+	if err != nil {
+		closeTracks(tracks)
+		return err
+	}
+	if res.StatusCode != 200 {
+		closeTracks(tracks)
+		return fmt.Errorf("PLAY returned code %d", res.StatusCode)
+	}
+
+	if !*ready {
+		*ready = true
+		onReady(s)
+	}
+
+	errc := make(chan error, len(tracks)*2+1)
+
+	if s.protocol == "tcp" {
+		go func() {
+			buf := make([]byte, 2048)
+			for {
+				channel, n, err := conn.ReadInterleavedFrame(buf)
+				if err != nil {
+					errc <- err
+					return
+				}
+
+				flow := FlowRTP
+				if channel%2 != 0 {
+					flow = FlowRTCP
+				}
+
+				s.onPacket(channel/2, flow, buf[:n])
+			}
+		}()
+	} else {
+		for i, t := range tracks {
+			go readUdpLoop(t.rtpConn, i, FlowRTP, s.onPacket, errc)
+			go readUdpLoop(t.rtcpConn, i, FlowRTCP, s.onPacket, errc)
+		}
+	}
+
+	var runErr error
+	select {
+	case <-s.terminate:
+	case runErr = <-errc:
+	}
+
+	closeTracks(tracks)
+
+	return runErr
+}
+
+func listenUdpPair() (*net.UDPConn, *net.UDPConn, error) {
+	rtpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		rtpConn.Close()
+		return nil, nil, err
+	}
+
+	return rtpConn, rtcpConn, nil
+}
+
+func readUdpLoop(conn *net.UDPConn, trackId int, flow Flow, onPacket OnPacket, errc chan error) {
+	if conn == nil {
+		return
+	}
+
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		onPacket(trackId, flow, buf[:n])
+	}
+}
+
+func closeTracks(tracks []track) {
+	for _, t := range tracks {
+		if t.rtpConn != nil {
+			t.rtpConn.Close()
+		}
+		if t.rtcpConn != nil {
+			t.rtcpConn.Close()
+		}
+	}
+}
+
+// parseSessionHeader extracts the session id from a RTSP Session header,
+// discarding any trailing ";timeout=N" parameter.
+func parseSessionHeader(header string) string {
+	return strings.TrimSpace(strings.SplitN(header, ";", 2)[0])
+}
+
+// resolveControlURL turns a SDP "a=control:" attribute into an absolute
+// URL. An empty or "*" attribute means "use the base URL itself" (RFC
+// 2326 section C.1.1); anything else is either already absolute or
+// relative to base.
+func resolveControlURL(base, control string) (string, error) {
+	if control == "" || control == "*" {
+		return base, nil
+	}
+
+	bu, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+
+	cu, err := url.Parse(control)
+	if err != nil {
+		return "", err
+	}
+
+	return bu.ResolveReference(cu).String(), nil
+}
+
+func decodeSdp(content []byte) (*sdp.Message, error) {
+	s, err := sdp.DecodeSession(content, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &sdp.Message{}
+	d := sdp.NewDecoder(s)
+	err = d.Decode(m)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
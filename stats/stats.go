@@ -0,0 +1,139 @@
+// Package stats holds process-wide counters describing server and
+// per-path stream health, and exposes them in Prometheus text exposition
+// format.
+package stats
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// path holds the counters tracked for a single path.
+type path struct {
+	bytesReceived  uint64
+	bytesSent      uint64
+	rtpPacketsLost uint32
+
+	mutex     sync.Mutex
+	rtpJitter float64
+}
+
+// Stats is a process-wide set of counters, safe for concurrent use.
+type Stats struct {
+	clientCount    int64
+	publisherCount int64
+	readerCount    int64
+
+	mutex sync.Mutex
+	paths map[string]*path
+}
+
+// New allocates a Stats.
+func New() *Stats {
+	return &Stats{
+		paths: make(map[string]*path),
+	}
+}
+
+func (s *Stats) path(name string) *path {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	p, ok := s.paths[name]
+	if !ok {
+		p = &path{}
+		s.paths[name] = p
+	}
+	return p
+}
+
+// ClientAdd adds delta to the count of connected RTSP clients.
+func (s *Stats) ClientAdd(delta int64) {
+	atomic.AddInt64(&s.clientCount, delta)
+}
+
+// PublisherAdd adds delta to the count of active publishers.
+func (s *Stats) PublisherAdd(delta int64) {
+	atomic.AddInt64(&s.publisherCount, delta)
+}
+
+// ReaderAdd adds delta to the count of active readers.
+func (s *Stats) ReaderAdd(delta int64) {
+	atomic.AddInt64(&s.readerCount, delta)
+}
+
+// AddBytesReceived adds n to the bytes received on path.
+func (s *Stats) AddBytesReceived(path string, n uint64) {
+	atomic.AddUint64(&s.path(path).bytesReceived, n)
+}
+
+// AddBytesSent adds n to the bytes sent on path.
+func (s *Stats) AddBytesSent(path string, n uint64) {
+	atomic.AddUint64(&s.path(path).bytesSent, n)
+}
+
+// SetRtpStats sets the cumulative packets-lost and jitter counters
+// reported for path, as computed by a rtcpreceiver.Receiver.
+func (s *Stats) SetRtpStats(path string, lost uint32, jitter float64) {
+	p := s.path(path)
+
+	atomic.StoreUint32(&p.rtpPacketsLost, lost)
+
+	p.mutex.Lock()
+	p.rtpJitter = jitter
+	p.mutex.Unlock()
+}
+
+// ServeHTTP implements http.Handler, writing every counter in Prometheus
+// text exposition format.
+func (s *Stats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprint(w, "# HELP rtsp_clients Number of connected RTSP clients.\n")
+	fmt.Fprint(w, "# TYPE rtsp_clients gauge\n")
+	fmt.Fprintf(w, "rtsp_clients %d\n", atomic.LoadInt64(&s.clientCount))
+
+	fmt.Fprint(w, "# HELP rtsp_publishers Number of active publishers.\n")
+	fmt.Fprint(w, "# TYPE rtsp_publishers gauge\n")
+	fmt.Fprintf(w, "rtsp_publishers %d\n", atomic.LoadInt64(&s.publisherCount))
+
+	fmt.Fprint(w, "# HELP rtsp_readers Number of active readers.\n")
+	fmt.Fprint(w, "# TYPE rtsp_readers gauge\n")
+	fmt.Fprintf(w, "rtsp_readers %d\n", atomic.LoadInt64(&s.readerCount))
+
+	s.mutex.Lock()
+	paths := make(map[string]*path, len(s.paths))
+	for name, p := range s.paths {
+		paths[name] = p
+	}
+	s.mutex.Unlock()
+
+	fmt.Fprint(w, "# HELP rtsp_path_bytes_received_total Bytes received on a path.\n")
+	fmt.Fprint(w, "# TYPE rtsp_path_bytes_received_total counter\n")
+	for name, p := range paths {
+		fmt.Fprintf(w, "rtsp_path_bytes_received_total{path=%q} %d\n", name, atomic.LoadUint64(&p.bytesReceived))
+	}
+
+	fmt.Fprint(w, "# HELP rtsp_path_bytes_sent_total Bytes sent on a path.\n")
+	fmt.Fprint(w, "# TYPE rtsp_path_bytes_sent_total counter\n")
+	for name, p := range paths {
+		fmt.Fprintf(w, "rtsp_path_bytes_sent_total{path=%q} %d\n", name, atomic.LoadUint64(&p.bytesSent))
+	}
+
+	fmt.Fprint(w, "# HELP rtsp_path_rtp_packets_lost Cumulative RTP packets lost on a path.\n")
+	fmt.Fprint(w, "# TYPE rtsp_path_rtp_packets_lost gauge\n")
+	for name, p := range paths {
+		fmt.Fprintf(w, "rtsp_path_rtp_packets_lost{path=%q} %d\n", name, atomic.LoadUint32(&p.rtpPacketsLost))
+	}
+
+	fmt.Fprint(w, "# HELP rtsp_path_rtp_jitter_seconds RTP interarrival jitter on a path.\n")
+	fmt.Fprint(w, "# TYPE rtsp_path_rtp_jitter_seconds gauge\n")
+	for name, p := range paths {
+		p.mutex.Lock()
+		jitter := p.rtpJitter
+		p.mutex.Unlock()
+		fmt.Fprintf(w, "rtsp_path_rtp_jitter_seconds{path=%q} %f\n", name, jitter)
+	}
+}
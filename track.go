@@ -0,0 +1,50 @@
+package main
+
+import "rtsp-server/rtcpreceiver"
+
+// trackFlow identifies whether a packet belongs to the RTP or RTCP flow
+// of a track.
+type trackFlow int
+
+const (
+	_TRACK_FLOW_RTP trackFlow = iota
+	_TRACK_FLOW_RTCP
+)
+
+func (tf trackFlow) String() string {
+	if tf == _TRACK_FLOW_RTP {
+		return "RTP"
+	}
+	return "RTCP"
+}
+
+// streamProtocol is the transport protocol used to carry a stream.
+type streamProtocol int
+
+const (
+	_STREAM_PROTOCOL_UDP streamProtocol = iota
+	_STREAM_PROTOCOL_TCP
+)
+
+func (sp streamProtocol) String() string {
+	if sp == _STREAM_PROTOCOL_UDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// track represents a single media track negotiated via SETUP, together
+// with the client ports it was set up with (UDP only; zero for TCP).
+type track struct {
+	rtpPort      int
+	rtcpPort     int
+	rtcpReceiver *rtcpreceiver.Receiver
+}
+
+func newTrack(rtpPort, rtcpPort int) *track {
+	return &track{
+		rtpPort:      rtpPort,
+		rtcpPort:     rtcpPort,
+		rtcpReceiver: rtcpreceiver.New(rtcpreceiver.DefaultClockRate),
+	}
+}